@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Implemented by every internal representation combineImages can build. All
+// of them store the same 3 abstract components per pixel (something
+// hue-like in channel 0, something saturation/chroma-like in channel 1, and
+// something lightness-like in channel 2); they differ only in how RGBA()
+// interprets those components.
+type ChannelImage interface {
+	image.Image
+	// Sets a component of each of this image's pixels based on the
+	// brightness of the corresponding pixel in pic. componentOffset must
+	// be 0, 1, or 2, selecting channel 0, 1, or 2 respectively.
+	SetComponent(pic image.Image, componentOffset int) error
+	// "Rotates" the value of channel 0 of every pixel forward by amount.
+	AdjustHue(amount float64)
+}
+
+// The brightness formula used to reduce an arbitrarily-colored source pixel
+// to the single value written into a ChannelImage's component.
+type lumaMode int
+
+const (
+	// (r + g + b) / 3, using the raw sRGB-encoded component values. This
+	// is what the tool has always done, and remains the default.
+	lumaAverage lumaMode = iota
+	// The ITU-R BT.601 luma formula.
+	lumaRec601
+	// The ITU-R BT.709 luma formula, which better matches modern
+	// displays and human perception than rec601.
+	lumaRec709
+	// Decodes sRGB gamma to linear light, applies the rec709 weights,
+	// then re-encodes back to sRGB. Avoids rec709's tendency to make
+	// mid-tones look too dark, since the weights are only valid for
+	// linear-light values.
+	lumaLinear
+)
+
+// Parses the value of the -luma flag.
+func parseLumaMode(s string) (lumaMode, error) {
+	switch s {
+	case "average":
+		return lumaAverage, nil
+	case "rec601":
+		return lumaRec601, nil
+	case "rec709":
+		return lumaRec709, nil
+	case "linear":
+		return lumaLinear, nil
+	}
+	return lumaAverage, fmt.Errorf("Unknown luma mode %q", s)
+}
+
+// Decodes an sRGB-gamma-encoded component value in [0, 1] to linear light.
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// The inverse of srgbToLinear.
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1.0/2.4) - 0.055
+}
+
+// Converts c to a single brightness value in [0, 1], using the given luma
+// formula.
+func convertToBrightness(c color.Color, mode lumaMode) float64 {
+	r, g, b, _ := c.RGBA()
+	rf := float64(r) / 0xffff
+	gf := float64(g) / 0xffff
+	bf := float64(b) / 0xffff
+	switch mode {
+	case lumaRec601:
+		return clamp(0.299*rf + 0.587*gf + 0.114*bf)
+	case lumaRec709:
+		return clamp(0.2126*rf + 0.7152*gf + 0.0722*bf)
+	case lumaLinear:
+		linear := 0.2126*srgbToLinear(rf) + 0.7152*srgbToLinear(gf) +
+			0.0722*srgbToLinear(bf)
+		return clamp(linearToSRGB(linear))
+	}
+	return clamp((rf + gf + bf) / 3.0)
+}
+
+// Returns R, G, B, given a particular hue value.
+func hueToRGB(h float64) (float64, float64, float64) {
+	r := math.Abs((h*6.0)-3.0) - 1.0
+	g := 2.0 - math.Abs((h*6.0)-2.0)
+	b := 2.0 - math.Abs((h*6.0)-4.0)
+	return clamp(r), clamp(g), clamp(b)
+}
+
+// Holds the raw 3-component pixel data shared by every ChannelImage
+// implementation, along with the logic for populating and rotating those
+// components that doesn't depend on how they map to RGB. Concrete types
+// embed this and only need to implement At() and RGBA() for their own pixel
+// color type.
+type channelBuffer struct {
+	// We'll keep the pixel data in a single slice to avoid any possible
+	// padding if we use a slice of color structs instead.
+	pixels []uint16
+	w, h   int
+	luma   lumaMode
+}
+
+func newChannelBuffer(w, h int, luma lumaMode) (channelBuffer, error) {
+	if (w <= 0) || (h <= 0) {
+		return channelBuffer{}, fmt.Errorf("Image bounds must be positive")
+	}
+	return channelBuffer{
+		w:      w,
+		h:      h,
+		luma:   luma,
+		pixels: make([]uint16, 3*w*h),
+	}, nil
+}
+
+func (b *channelBuffer) Bounds() image.Rectangle {
+	return image.Rect(0, 0, b.w, b.h)
+}
+
+func (b *channelBuffer) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+// Returns the 3 raw component values at (x, y), or a separate, all-zero,
+// slice if the coordinate is outside of the image boundaries.
+func (b *channelBuffer) components(x, y int) []uint16 {
+	if (x < 0) || (y < 0) || (x >= b.w) || (y >= b.h) {
+		return []uint16{0, 0, 0}
+	}
+	i := 3 * (y*b.w + x)
+	return b.pixels[i : i+3]
+}
+
+// Takes another image and sets a component of each of this image's pixels
+// based on the brightness of each pixel in pic. The "componentOffset" must
+// be 0, 1, or 2. The caller must ensure pic's bounds are exactly (w, h);
+// combineImages does this by resizing every input to the combined canvas
+// before calling here.
+func (b *channelBuffer) SetComponent(pic image.Image, componentOffset int) error {
+	if (componentOffset < 0) || (componentOffset > 2) {
+		return fmt.Errorf("Invalid component offset: %d", componentOffset)
+	}
+	bounds := pic.Bounds()
+	if (bounds.Dx() != b.w) || (bounds.Dy() != b.h) {
+		return fmt.Errorf("Image bounds %s don't match the combined "+
+			"image's %dx%d size", bounds, b.w, b.h)
+	}
+	for y := 0; y < b.h; y++ {
+		for x := 0; x < b.w; x++ {
+			c := b.components(x, y)
+			c[componentOffset] = scaleTo16Bit(convertToBrightness(
+				pic.At(bounds.Min.X+x, bounds.Min.Y+y), b.luma))
+		}
+	}
+	return nil
+}
+
+// "Rotates" the value of channel 0 of every pixel in the image forward by
+// the given amount.
+func (b *channelBuffer) AdjustHue(adjustment float64) {
+	for y := 0; y < b.h; y++ {
+		for x := 0; x < b.w; x++ {
+			c := b.components(x, y)
+			// We'll just let this wrap around to take care of the rotation.
+			c[0] += scaleTo16Bit(adjustment)
+		}
+	}
+}
+
+// Implements the color interface. Stores the H, S, and L components,
+// respectively. *This will panic if the slice doesn't contain at least 3
+// components.* Values after the first 3 are ignored. Each component is a
+// fraction out of 0xffff.
+type HSLColor []uint16
+
+// Utility function to convert the 3 16-bit values to fractional components.
+func (c HSLColor) HSLComponents() (float64, float64, float64) {
+	h := float64(c[0]) / float64(0xffff)
+	s := float64(c[1]) / float64(0xffff)
+	l := float64(c[2]) / float64(0xffff)
+	return h, s, l
+}
+
+func (c HSLColor) String() string {
+	h, s, l := c.HSLComponents()
+	return fmt.Sprintf("(%f, %f, %f)", h, s, l)
+}
+
+// I based this code off of the snippet here:
+// https://gist.github.com/mathebox/e0805f72e7db3269ec22
+func (c HSLColor) RGBA() (r, g, b, a uint32) {
+	h, s, l := c.HSLComponents()
+	r1, g1, b1 := hueToRGB(h)
+	chroma := (1.0 - math.Abs(2.0*l-1)) * s
+	r1 = (r1-0.5)*chroma + l
+	g1 = (g1-0.5)*chroma + l
+	b1 = (b1-0.5)*chroma + l
+	r = uint32(scaleTo16Bit(r1))
+	g = uint32(scaleTo16Bit(g1))
+	b = uint32(scaleTo16Bit(b1))
+	a = 0xffff
+	return
+}
+
+// Implements the ChannelImage interface. Internally uses HSL representation
+// for each pixel.
+type HSLImage struct {
+	channelBuffer
+}
+
+func (i *HSLImage) At(x, y int) color.Color {
+	return HSLColor(i.components(x, y))
+}
+
+func newHSLImage(w, h int, luma lumaMode) (*HSLImage, error) {
+	b, e := newChannelBuffer(w, h, luma)
+	if e != nil {
+		return nil, e
+	}
+	return &HSLImage{channelBuffer: b}, nil
+}
+
+// Implements the color interface for a 3-component HSV pixel: hue,
+// saturation, and value, each a fraction out of 0xffff.
+type HSVColor []uint16
+
+func (c HSVColor) HSVComponents() (float64, float64, float64) {
+	h := float64(c[0]) / float64(0xffff)
+	s := float64(c[1]) / float64(0xffff)
+	v := float64(c[2]) / float64(0xffff)
+	return h, s, v
+}
+
+func (c HSVColor) RGBA() (r, g, b, a uint32) {
+	h, s, v := c.HSVComponents()
+	chroma := v * s
+	hp := h * 6.0
+	x := chroma * (1.0 - math.Abs(math.Mod(hp, 2.0)-1.0))
+	var r1, g1, b1 float64
+	switch {
+	case hp < 1.0:
+		r1, g1, b1 = chroma, x, 0.0
+	case hp < 2.0:
+		r1, g1, b1 = x, chroma, 0.0
+	case hp < 3.0:
+		r1, g1, b1 = 0.0, chroma, x
+	case hp < 4.0:
+		r1, g1, b1 = 0.0, x, chroma
+	case hp < 5.0:
+		r1, g1, b1 = x, 0.0, chroma
+	default:
+		r1, g1, b1 = chroma, 0.0, x
+	}
+	m := v - chroma
+	r = uint32(scaleTo16Bit(r1 + m))
+	g = uint32(scaleTo16Bit(g1 + m))
+	b = uint32(scaleTo16Bit(b1 + m))
+	a = 0xffff
+	return
+}
+
+// Implements the ChannelImage interface, using HSV representation for each
+// pixel.
+type HSVImage struct {
+	channelBuffer
+}
+
+func (i *HSVImage) At(x, y int) color.Color {
+	return HSVColor(i.components(x, y))
+}
+
+func newHSVImage(w, h int, luma lumaMode) (*HSVImage, error) {
+	b, e := newChannelBuffer(w, h, luma)
+	if e != nil {
+		return nil, e
+	}
+	return &HSVImage{channelBuffer: b}, nil
+}
+
+// Implements the color interface for a 3-component HSI pixel: hue,
+// saturation, and intensity, each a fraction out of 0xffff.
+type HSIColor []uint16
+
+func (c HSIColor) HSIComponents() (float64, float64, float64) {
+	h := float64(c[0]) / float64(0xffff)
+	s := float64(c[1]) / float64(0xffff)
+	i := float64(c[2]) / float64(0xffff)
+	return h, s, i
+}
+
+func (c HSIColor) RGBA() (r, g, b, a uint32) {
+	h, s, intensity := c.HSIComponents()
+	deg := h * 360.0
+	rad := func(d float64) float64 { return d * math.Pi / 180.0 }
+	var r1, g1, b1 float64
+	switch {
+	case deg < 120.0:
+		b1 = intensity * (1.0 - s)
+		r1 = intensity * (1.0 + s*math.Cos(rad(deg))/math.Cos(rad(60.0-deg)))
+		g1 = 3.0*intensity - (r1 + b1)
+	case deg < 240.0:
+		deg -= 120.0
+		r1 = intensity * (1.0 - s)
+		g1 = intensity * (1.0 + s*math.Cos(rad(deg))/math.Cos(rad(60.0-deg)))
+		b1 = 3.0*intensity - (r1 + g1)
+	default:
+		deg -= 240.0
+		g1 = intensity * (1.0 - s)
+		b1 = intensity * (1.0 + s*math.Cos(rad(deg))/math.Cos(rad(60.0-deg)))
+		r1 = 3.0*intensity - (g1 + b1)
+	}
+	r = uint32(scaleTo16Bit(r1))
+	g = uint32(scaleTo16Bit(g1))
+	b = uint32(scaleTo16Bit(b1))
+	a = 0xffff
+	return
+}
+
+// Implements the ChannelImage interface, using HSI representation for each
+// pixel.
+type HSIImage struct {
+	channelBuffer
+}
+
+func (i *HSIImage) At(x, y int) color.Color {
+	return HSIColor(i.components(x, y))
+}
+
+func newHSIImage(w, h int, luma lumaMode) (*HSIImage, error) {
+	b, e := newChannelBuffer(w, h, luma)
+	if e != nil {
+		return nil, e
+	}
+	return &HSIImage{channelBuffer: b}, nil
+}
+
+// Implements the color interface for a 3-component CIE LCh(ab) pixel: hue
+// angle, chroma, and lightness, each a fraction out of 0xffff. The hue
+// component stands in for "H" on the command line, chroma for "S", and
+// lightness for "L", mirroring the meaning those flags have for HSL.
+type HCLColor []uint16
+
+func (c HCLColor) HCLComponents() (float64, float64, float64) {
+	h := float64(c[0]) / float64(0xffff)
+	cc := float64(c[1]) / float64(0xffff)
+	l := float64(c[2]) / float64(0xffff)
+	return h, cc, l
+}
+
+// The D65 reference white point, in CIE XYZ.
+const (
+	whitePointX = 95.047
+	whitePointY = 100.0
+	whitePointZ = 108.883
+)
+
+func labInverseF(t float64) float64 {
+	if cube := t * t * t; cube > 0.008856 {
+		return cube
+	}
+	return (t - 16.0/116.0) / 7.787
+}
+
+// Converts this pixel's CIE LCh(ab) coordinates (with a D65 white point) to
+// sRGB. The hue fraction is scaled to a full turn, chroma to the rough
+// maximum reachable by the sRGB gamut, and lightness to CIE L*'s 0-100
+// range.
+func (c HCLColor) RGBA() (r, g, b, a uint32) {
+	hf, cf, lf := c.HCLComponents()
+	hueRadians := hf * 2.0 * math.Pi
+	chroma := cf * 134.0
+	lStar := lf * 100.0
+	aStar := chroma * math.Cos(hueRadians)
+	bStar := chroma * math.Sin(hueRadians)
+
+	fy := (lStar + 16.0) / 116.0
+	fx := fy + aStar/500.0
+	fz := fy - bStar/200.0
+	x := whitePointX * labInverseF(fx) / 100.0
+	y := whitePointY * labInverseF(fy) / 100.0
+	z := whitePointZ * labInverseF(fz) / 100.0
+
+	rLinear := 3.2406*x - 1.5372*y - 0.4986*z
+	gLinear := -0.9689*x + 1.8758*y + 0.0415*z
+	bLinear := 0.0557*x - 0.2040*y + 1.0570*z
+
+	r = uint32(scaleTo16Bit(linearToSRGB(clamp(rLinear))))
+	g = uint32(scaleTo16Bit(linearToSRGB(clamp(gLinear))))
+	b = uint32(scaleTo16Bit(linearToSRGB(clamp(bLinear))))
+	a = 0xffff
+	return
+}
+
+// Implements the ChannelImage interface, using CIE LCh(ab) representation
+// for each pixel.
+type HCLImage struct {
+	channelBuffer
+}
+
+func (i *HCLImage) At(x, y int) color.Color {
+	return HCLColor(i.components(x, y))
+}
+
+func newHCLImage(w, h int, luma lumaMode) (*HCLImage, error) {
+	b, e := newChannelBuffer(w, h, luma)
+	if e != nil {
+		return nil, e
+	}
+	return &HCLImage{channelBuffer: b}, nil
+}
+
+// Parses the value of the -colorspace flag.
+func parseColorspace(s string) (string, error) {
+	switch s {
+	case "hsl", "hsv", "hsi", "hcl":
+		return s, nil
+	}
+	return "", fmt.Errorf("Unknown colorspace %q", s)
+}
+
+// Creates a new ChannelImage of the given size, using the representation
+// named by colorspace ("hsl", "hsv", "hsi", or "hcl").
+func newChannelImage(colorspace string, w, h int, luma lumaMode) (ChannelImage,
+	error) {
+	switch colorspace {
+	case "hsv":
+		return newHSVImage(w, h, luma)
+	case "hsi":
+		return newHSIImage(w, h, luma)
+	case "hcl":
+		return newHCLImage(w, h, luma)
+	}
+	return newHSLImage(w, h, luma)
+}
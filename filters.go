@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Pre-processes a single channel's source image before it is mapped onto
+// the combined HSL image. Filters are applied in the order they're given on
+// the command line.
+type ImageFilter interface {
+	Apply(img image.Image) image.Image
+}
+
+// Applies fn to every pixel of img, treating each component as a fraction in
+// [0, 1], and returns the result as a new image.
+func applyPerPixel(img image.Image,
+	fn func(r, g, b, a float64) (float64, float64, float64, float64)) image.Image {
+	bounds := img.Bounds()
+	out := image.NewNRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			nr, ng, nb, na := fn(float64(r)/0xffff, float64(g)/0xffff,
+				float64(b)/0xffff, float64(a)/0xffff)
+			out.SetNRGBA64(x, y, color.NRGBA64{
+				R: scaleTo16Bit(nr),
+				G: scaleTo16Bit(ng),
+				B: scaleTo16Bit(nb),
+				A: scaleTo16Bit(na),
+			})
+		}
+	}
+	return out
+}
+
+// Raises each color component to the power of 1/gamma.
+type gammaFilter struct {
+	gamma float64
+}
+
+func (f gammaFilter) Apply(img image.Image) image.Image {
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		exponent := 1.0 / f.gamma
+		return math.Pow(r, exponent), math.Pow(g, exponent), math.Pow(b, exponent), a
+	})
+}
+
+// Adds a constant amount to each color component.
+type brightnessFilter struct {
+	amount float64
+}
+
+func (f brightnessFilter) Apply(img image.Image) image.Image {
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		return clamp(r + f.amount), clamp(g + f.amount), clamp(b + f.amount), a
+	})
+}
+
+// Scales each color component's distance from mid-gray (0.5) by amount.
+type contrastFilter struct {
+	amount float64
+}
+
+func (f contrastFilter) Apply(img image.Image) image.Image {
+	adjust := func(v float64) float64 {
+		return clamp((v-0.5)*f.amount + 0.5)
+	}
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		return adjust(r), adjust(g), adjust(b), a
+	})
+}
+
+// Scales each color component's distance from the pixel's own gray value by
+// amount. An amount of 0 produces grayscale; 1 leaves colors unchanged.
+type saturateFilter struct {
+	amount float64
+}
+
+func (f saturateFilter) Apply(img image.Image) image.Image {
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		gray := (r + g + b) / 3.0
+		adjust := func(v float64) float64 {
+			return clamp(gray + (v-gray)*f.amount)
+		}
+		return adjust(r), adjust(g), adjust(b), a
+	})
+}
+
+// Replaces each color component c with 1-c.
+type invertFilter struct{}
+
+func (f invertFilter) Apply(img image.Image) image.Image {
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		return 1.0 - r, 1.0 - g, 1.0 - b, a
+	})
+}
+
+// Maps each pixel to black or white depending on whether its average
+// brightness is below or at/above level.
+type thresholdFilter struct {
+	level float64
+}
+
+func (f thresholdFilter) Apply(img image.Image) image.Image {
+	return applyPerPixel(img, func(r, g, b, a float64) (float64, float64, float64, float64) {
+		if (r+g+b)/3.0 >= f.level {
+			return 1.0, 1.0, 1.0, a
+		}
+		return 0.0, 0.0, 0.0, a
+	})
+}
+
+// Blurs the image using a separable 1D Gaussian kernel of the given radius,
+// applied first horizontally, then vertically.
+type gaussianBlurFilter struct {
+	radius float64
+}
+
+func (f gaussianBlurFilter) Apply(img image.Image) image.Image {
+	if f.radius <= 0 {
+		return img
+	}
+	kernel := gaussianKernel(f.radius)
+	bounds := img.Bounds()
+	src := image.NewNRGBA64(bounds)
+	draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+	return convolve1D(convolve1D(src, kernel, true), kernel, false)
+}
+
+// Builds a normalized 1D Gaussian kernel covering +/- radius pixels.
+func gaussianKernel(radius float64) []float64 {
+	size := int(math.Ceil(radius))*2 + 1
+	sigma := radius / 2.0
+	kernel := make([]float64, size)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - size/2)
+		v := math.Exp(-(x * x) / (2 * sigma * sigma))
+		kernel[i] = v
+		sum += v
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// Convolves src with the given 1D kernel, either horizontally or vertically,
+// clamping reads to the image edges.
+func convolve1D(src *image.NRGBA64, kernel []float64, horizontal bool) *image.NRGBA64 {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA64(bounds)
+	radius := len(kernel) / 2
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b, a float64
+			for k, weight := range kernel {
+				offset := k - radius
+				sx, sy := x, y
+				if horizontal {
+					sx = clampInt(x+offset, bounds.Min.X, bounds.Max.X-1)
+				} else {
+					sy = clampInt(y+offset, bounds.Min.Y, bounds.Max.Y-1)
+				}
+				c := src.NRGBA64At(sx, sy)
+				r += float64(c.R) * weight
+				g += float64(c.G) * weight
+				b += float64(c.B) * weight
+				a += float64(c.A) * weight
+			}
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(clampFloat(r, 0, 0xffff)),
+				G: uint16(clampFloat(g, 0, 0xffff)),
+				B: uint16(clampFloat(b, 0, 0xffff)),
+				A: uint16(clampFloat(a, 0, 0xffff)),
+			})
+		}
+	}
+	return dst
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func clampFloat(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// Parses a comma-separated list of "name=value" filters, such as
+// "gamma=2.2,blur=3", in the order they should be applied. An empty spec
+// returns a nil slice and no error.
+func parseFilterSpec(spec string) ([]ImageFilter, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	var filters []ImageFilter
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameValue := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(nameValue[0]))
+		value := 0.0
+		if len(nameValue) == 2 {
+			v, e := strconv.ParseFloat(strings.TrimSpace(nameValue[1]), 64)
+			if e != nil {
+				return nil, fmt.Errorf("Invalid value for filter %q: %s", name, e)
+			}
+			value = v
+		}
+		switch name {
+		case "gamma":
+			filters = append(filters, gammaFilter{gamma: value})
+		case "blur", "gaussianblur":
+			filters = append(filters, gaussianBlurFilter{radius: value})
+		case "saturate":
+			filters = append(filters, saturateFilter{amount: value})
+		case "brightness":
+			filters = append(filters, brightnessFilter{amount: value})
+		case "contrast":
+			filters = append(filters, contrastFilter{amount: value})
+		case "invert":
+			filters = append(filters, invertFilter{})
+		case "threshold":
+			filters = append(filters, thresholdFilter{level: value})
+		default:
+			return nil, fmt.Errorf("Unknown filter %q", name)
+		}
+	}
+	return filters, nil
+}
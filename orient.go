@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Applies the transform implied by the given EXIF orientation tag value (1-8,
+// per the TIFF/EXIF spec) to pic. Unrecognized values are treated as 1 (no
+// transform).
+func applyOrientation(pic image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(pic)
+	case 3:
+		return imaging.Rotate180(pic)
+	case 4:
+		return imaging.FlipV(pic)
+	case 5:
+		return imaging.Transpose(pic)
+	case 6:
+		return imaging.Rotate270(pic)
+	case 7:
+		return imaging.Transverse(pic)
+	case 8:
+		return imaging.Rotate90(pic)
+	}
+	return pic
+}
+
+// Reads the EXIF orientation tag (if present) from filename and returns the
+// value, or 1 (the "no rotation needed" value) if the file has no readable
+// EXIF data or orientation tag.
+func readOrientation(f *os.File) int {
+	x, e := exif.Decode(f)
+	if e != nil {
+		return 1
+	}
+	tag, e := x.Get(exif.Orientation)
+	if e != nil {
+		return 1
+	}
+	v, e := tag.Int(0)
+	if e != nil {
+		return 1
+	}
+	return v
+}
+
+// Decodes the image in filename, applying the rotation or flip implied by
+// its EXIF Orientation tag (if any and if autoRotate is true) so that the
+// returned image always appears right-side-up.
+func decodeOriented(filename string, autoRotate bool) (image.Image, error) {
+	f, e := os.Open(filename)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s: %s", filename, e)
+	}
+	defer f.Close()
+	orientation := 1
+	if autoRotate {
+		orientation = readOrientation(f)
+		if _, e = f.Seek(0, io.SeekStart); e != nil {
+			return nil, fmt.Errorf("Failed rewinding %s: %s", filename, e)
+		}
+	}
+	pic, _, e := image.Decode(f)
+	if e != nil {
+		return nil, fmt.Errorf("Failed decoding %s: %s", filename, e)
+	}
+	return applyOrientation(pic, orientation), nil
+}
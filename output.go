@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Normalizes a user-supplied format or file extension to one of "jpeg",
+// "png", "bmp", "tiff", or "gif".
+func normalizeFormat(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "jpg", "jpeg":
+		return "jpeg", nil
+	case "png":
+		return "png", nil
+	case "bmp":
+		return "bmp", nil
+	case "tif", "tiff":
+		return "tiff", nil
+	case "gif":
+		return "gif", nil
+	}
+	return "", fmt.Errorf("Unrecognized image format %q", s)
+}
+
+// Picks the output format: the -format flag if it was given (an invalid
+// value here is an error), otherwise the output filename's extension,
+// defaulting to "jpeg" if that extension is missing or unrecognized.
+func outputFormat(explicitFormat, filename string) (string, error) {
+	if explicitFormat != "" {
+		return normalizeFormat(explicitFormat)
+	}
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	format, e := normalizeFormat(ext)
+	if e != nil {
+		return "jpeg", nil
+	}
+	return format, nil
+}
+
+// Writes img to filename using the given format ("jpeg", "png", "bmp",
+// "tiff", or "gif"). quality only affects the "jpeg" format. PNG output
+// preserves the full 16-bit-per-channel precision the combined image is
+// computed at; GIF output is quantized to a 256-color palette with
+// Floyd-Steinberg dithering.
+func writeOutputImage(img image.Image, filename, format string, quality int) error {
+	f, e := os.Create(filename)
+	if e != nil {
+		return fmt.Errorf("Failed creating %s: %s", filename, e)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	switch format {
+	case "png":
+		e = png.Encode(w, img)
+	case "bmp":
+		e = bmp.Encode(w, img)
+	case "tiff":
+		e = tiff.Encode(w, img, nil)
+	case "gif":
+		e = writeGIF(w, img)
+	default:
+		e = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	if e != nil {
+		return fmt.Errorf("Failed encoding %s image: %s", format, e)
+	}
+	return w.Flush()
+}
+
+// Quantizes img down to a 256-color palette via median-cut, dithers it with
+// Floyd-Steinberg error diffusion, and writes it as a GIF.
+func writeGIF(w io.Writer, img image.Image) error {
+	palette := medianCutPalette(img, 256)
+	paletted := ditherFloydSteinberg(img, palette)
+	return gif.Encode(w, paletted, nil)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// One bucket in the median-cut algorithm: a set of source colors that will
+// collapse to a single palette entry. Each color is stored as 8-bit
+// [R, G, B].
+type colorBox struct {
+	colors [][3]int
+}
+
+// Returns the smallest and largest value of the given channel (0=R, 1=G,
+// 2=B) across every color in the box.
+func (b colorBox) channelRange(channel int) (int, int) {
+	lo, hi := b.colors[0][channel], b.colors[0][channel]
+	for _, c := range b.colors[1:] {
+		if c[channel] < lo {
+			lo = c[channel]
+		}
+		if c[channel] > hi {
+			hi = c[channel]
+		}
+	}
+	return lo, hi
+}
+
+// Returns the channel (0=R, 1=G, 2=B) with the widest range of values in
+// this box.
+func (b colorBox) longestAxis() int {
+	best, bestRange := 0, -1
+	for channel := 0; channel < 3; channel++ {
+		lo, hi := b.channelRange(channel)
+		if (hi - lo) > bestRange {
+			best, bestRange = channel, hi-lo
+		}
+	}
+	return best
+}
+
+// Returns the mean color of every color in the box.
+func (b colorBox) average() color.RGBA {
+	var rSum, gSum, bSum int
+	for _, c := range b.colors {
+		rSum += c[0]
+		gSum += c[1]
+		bSum += c[2]
+	}
+	n := len(b.colors)
+	return color.RGBA{
+		R: uint8(rSum / n),
+		G: uint8(gSum / n),
+		B: uint8(bSum / n),
+		A: 0xff,
+	}
+}
+
+// Splits the box in half along its longest axis, sorted by that channel's
+// value, so each half has roughly the same number of colors.
+func (b colorBox) split() (colorBox, colorBox) {
+	axis := b.longestAxis()
+	sorted := make([][3]int, len(b.colors))
+	copy(sorted, b.colors)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][axis] < sorted[j][axis]
+	})
+	mid := len(sorted) / 2
+	return colorBox{colors: sorted[:mid]}, colorBox{colors: sorted[mid:]}
+}
+
+// Builds a palette of at most maxColors entries for img using median-cut
+// quantization: starting from a single box containing every pixel's color,
+// repeatedly splits the box with the most colors along its widest-range
+// channel, until there are enough boxes or no box has more than one color
+// left to split.
+func medianCutPalette(img image.Image, maxColors int) color.Palette {
+	bounds := img.Bounds()
+	colors := make([][3]int, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			colors = append(colors, [3]int{int(r >> 8), int(g >> 8), int(b >> 8)})
+		}
+	}
+	if len(colors) == 0 {
+		return color.Palette{color.RGBA{A: 0xff}}
+	}
+	boxes := []colorBox{{colors: colors}}
+	for len(boxes) < maxColors {
+		splitIndex := 0
+		for i, b := range boxes {
+			if len(b.colors) > len(boxes[splitIndex].colors) {
+				splitIndex = i
+			}
+		}
+		if len(boxes[splitIndex].colors) < 2 {
+			break
+		}
+		a, b := boxes[splitIndex].split()
+		boxes[splitIndex] = a
+		boxes = append(boxes, b)
+	}
+	palette := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		palette[i] = b.average()
+	}
+	return palette
+}
+
+// Converts img to a paletted image using the given palette, applying
+// Floyd-Steinberg error diffusion: the quantization error at each pixel is
+// propagated to its right, below-left, below, and below-right neighbors,
+// weighted 7/16, 3/16, 5/16, and 1/16 respectively.
+func ditherFloydSteinberg(img image.Image, palette color.Palette) *image.Paletted {
+	bounds := img.Bounds()
+	out := image.NewPaletted(bounds, palette)
+	pending := make([][3]float64, bounds.Dx()*bounds.Dy())
+	index := func(x, y int) int {
+		return (y-bounds.Min.Y)*bounds.Dx() + (x - bounds.Min.X)
+	}
+	diffuse := func(x, y int, errR, errG, errB, weight float64) {
+		if (x < bounds.Min.X) || (x >= bounds.Max.X) ||
+			(y < bounds.Min.Y) || (y >= bounds.Max.Y) {
+			return
+		}
+		e := &pending[index(x, y)]
+		e[0] += errR * weight
+		e[1] += errG * weight
+		e[2] += errB * weight
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			e := pending[index(x, y)]
+			rf := clampFloat(float64(r>>8)+e[0], 0, 255)
+			gf := clampFloat(float64(g>>8)+e[1], 0, 255)
+			bf := clampFloat(float64(b>>8)+e[2], 0, 255)
+			paletteIndex := palette.Index(color.RGBA{
+				R: uint8(rf), G: uint8(gf), B: uint8(bf), A: 0xff,
+			})
+			out.SetColorIndex(x, y, uint8(paletteIndex))
+			chosen := palette[paletteIndex].(color.RGBA)
+			errR := rf - float64(chosen.R)
+			errG := gf - float64(chosen.G)
+			errB := bf - float64(chosen.B)
+			diffuse(x+1, y, errR, errG, errB, 7.0/16.0)
+			diffuse(x-1, y+1, errR, errG, errB, 3.0/16.0)
+			diffuse(x, y+1, errR, errG, errB, 5.0/16.0)
+			diffuse(x+1, y+1, errR, errG, errB, 1.0/16.0)
+		}
+	}
+	return out
+}
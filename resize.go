@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// Controls how an input image's aspect ratio is handled when it doesn't
+// match the combined canvas.
+type fitMode int
+
+const (
+	// Stretches the image to exactly fill the canvas, distorting its
+	// aspect ratio if necessary.
+	fitStretch fitMode = iota
+	// Scales the image down to fit entirely within the canvas, preserving
+	// aspect ratio, and letterboxes any leftover space with black so the
+	// result is still exactly the canvas size (every ChannelImage requires
+	// its inputs' bounds to match exactly). This makes fitContain and
+	// fitPad equivalent here; fitPad exists only as an explicit alias for
+	// users who expect "pad" to name that behavior.
+	fitContain
+	// Scales the image up to fill the canvas entirely, preserving aspect
+	// ratio and cropping any excess.
+	fitCover
+	// An alias for fitContain; see its comment.
+	fitPad
+)
+
+// Parses the value of the -fit flag.
+func parseFitMode(s string) (fitMode, error) {
+	switch s {
+	case "stretch":
+		return fitStretch, nil
+	case "contain":
+		return fitContain, nil
+	case "cover":
+		return fitCover, nil
+	case "pad":
+		return fitPad, nil
+	}
+	return fitStretch, fmt.Errorf("Unknown fit mode %q", s)
+}
+
+// Parses the value of the -resample flag.
+func parseResampleFilter(s string) (imaging.ResampleFilter, error) {
+	switch s {
+	case "nearest":
+		return imaging.NearestNeighbor, nil
+	case "bilinear":
+		return imaging.Linear, nil
+	case "bicubic":
+		return imaging.CatmullRom, nil
+	case "lanczos":
+		return imaging.Lanczos, nil
+	}
+	return imaging.Linear, fmt.Errorf("Unknown resampling filter %q", s)
+}
+
+// Resizes pic to exactly (w, h), using the given fit mode to decide how to
+// handle a source aspect ratio that doesn't match the destination. The
+// returned image always has bounds starting at (0, 0) and size (w, h), so
+// callers never need to worry about a mismatched or offset source image.
+func resizeToCanvas(pic image.Image, w, h int, fit fitMode,
+	filter imaging.ResampleFilter) image.Image {
+	switch fit {
+	case fitCover:
+		return imaging.Fill(pic, w, h, imaging.Center, filter)
+	case fitContain, fitPad:
+		// Both modes scale the image down to fit entirely within the
+		// canvas and letterbox the rest with black; since the canvas this
+		// tool builds only ever has a single solid background color,
+		// there's no distinction between "contain" and an explicit "pad"
+		// here.
+		fitted := imaging.Fit(pic, w, h, filter)
+		return imaging.PasteCenter(imaging.New(w, h, color.Black), fitted)
+	}
+	return imaging.Resize(pic, w, h, filter)
+}